@@ -0,0 +1,654 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Xe/ln"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	activityPubActorID     = "https://christine.website/activitypub/actor"
+	activityPubContentType = `application/activity+json; charset=utf-8`
+	activityStreamsContext = "https://www.w3.org/ns/activitystreams"
+)
+
+var followersBucket = []byte("followers")
+
+// activityPubKey holds the actor's RSA keypair, used both to publish the
+// actor's publicKey and to sign outgoing deliveries.
+type activityPubKey struct {
+	private *rsa.PrivateKey
+	pem     string
+}
+
+// loadOrCreateActivityPubKey reads the actor's RSA keypair from disk,
+// generating and persisting a new one on first run.
+func loadOrCreateActivityPubKey(path string) (*activityPubKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("activitypub: %s does not contain a PEM block", path)
+		}
+		priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newActivityPubKey(priv)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+
+	return newActivityPubKey(priv)
+}
+
+func newActivityPubKey(priv *rsa.PrivateKey) (*activityPubKey, error) {
+	pubBytes, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes})
+
+	return &activityPubKey{private: priv, pem: string(pubPEM)}, nil
+}
+
+// activityPubStore persists the blog's ActivityPub followers.
+type activityPubStore struct {
+	db *bolt.DB
+}
+
+func newActivityPubStore(path string) (*activityPubStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(followersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &activityPubStore{db: db}, nil
+}
+
+func (a *activityPubStore) AddFollower(actorID, sharedInbox string) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(followersBucket).Put([]byte(actorID), []byte(sharedInbox))
+	})
+}
+
+func (a *activityPubStore) RemoveFollower(actorID string) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(followersBucket).Delete([]byte(actorID))
+	})
+}
+
+// SharedInboxes returns the deduplicated set of sharedInbox URLs for every
+// current follower.
+func (a *activityPubStore) SharedInboxes() ([]string, error) {
+	seen := map[string]bool{}
+	var inboxes []string
+
+	err := a.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(followersBucket).ForEach(func(_, v []byte) error {
+			if !seen[string(v)] {
+				seen[string(v)] = true
+				inboxes = append(inboxes, string(v))
+			}
+			return nil
+		})
+	})
+
+	sort.Strings(inboxes)
+	return inboxes, err
+}
+
+func (a *activityPubStore) Count() (int, error) {
+	n := 0
+	err := a.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(followersBucket).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+// Followers returns every follower's actor ID.
+func (a *activityPubStore) Followers() ([]string, error) {
+	var actorIDs []string
+
+	err := a.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(followersBucket).ForEach(func(k, _ []byte) error {
+			actorIDs = append(actorIDs, string(k))
+			return nil
+		})
+	})
+
+	sort.Strings(actorIDs)
+	return actorIDs, err
+}
+
+// webfingerHandler implements RFC 7033 WebFinger discovery for the blog's
+// ActivityPub actor.
+func (s *Site) webfingerHandler(w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+	if resource != "acct:christine@christine.website" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/jrd+json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"subject": resource,
+		"links": []map[string]string{
+			{
+				"rel":  "self",
+				"type": "application/activity+json",
+				"href": activityPubActorID,
+			},
+		},
+	})
+}
+
+// actorHandler returns the AS2 Person object for the blog.
+func (s *Site) actorHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", activityPubContentType)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"@context":          []string{activityStreamsContext, "https://w3id.org/security/v1"},
+		"id":                activityPubActorID,
+		"type":              "Person",
+		"preferredUsername": "christine",
+		"name":              "Christine Dodrill",
+		"inbox":             "https://christine.website/activitypub/inbox",
+		"outbox":            "https://christine.website/activitypub/outbox",
+		"followers":         "https://christine.website/activitypub/followers",
+		"url":               "https://christine.website/",
+		"publicKey": map[string]string{
+			"id":           activityPubActorID + "#main-key",
+			"owner":        activityPubActorID,
+			"publicKeyPem": s.apKey.pem,
+		},
+	})
+}
+
+// followersHandler returns the actor's followers collection. It's small
+// enough in practice not to need outbox-style pagination.
+func (s *Site) followersHandler(w http.ResponseWriter, r *http.Request) {
+	actorIDs, err := s.apStore.Followers()
+	if err != nil {
+		ln.Error(r.Context(), err, ln.Action("Followers"))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	items := make([]interface{}, len(actorIDs))
+	for i, id := range actorIDs {
+		items[i] = id
+	}
+
+	w.Header().Set("Content-Type", activityPubContentType)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"@context":     activityStreamsContext,
+		"id":           "https://christine.website/activitypub/followers",
+		"type":         "OrderedCollection",
+		"totalItems":   len(actorIDs),
+		"orderedItems": items,
+	})
+}
+
+const outboxPageSize = 20
+
+// outboxHandler paginates s.Posts as Create{Note} activities.
+func (s *Site) outboxHandler(w http.ResponseWriter, r *http.Request) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+
+	s.mu.RLock()
+	posts := s.Posts
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", activityPubContentType)
+
+	if page < 1 {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"@context":   activityStreamsContext,
+			"id":         "https://christine.website/activitypub/outbox",
+			"type":       "OrderedCollection",
+			"totalItems": len(posts),
+			"first":      "https://christine.website/activitypub/outbox?page=1",
+		})
+		return
+	}
+
+	start := (page - 1) * outboxPageSize
+	if start >= len(posts) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"@context":     activityStreamsContext,
+			"id":           fmt.Sprintf("https://christine.website/activitypub/outbox?page=%d", page),
+			"type":         "OrderedCollectionPage",
+			"partOf":       "https://christine.website/activitypub/outbox",
+			"orderedItems": []interface{}{},
+		})
+		return
+	}
+
+	end := start + outboxPageSize
+	if end > len(posts) {
+		end = len(posts)
+	}
+
+	items := make([]interface{}, 0, end-start)
+	for _, p := range posts[start:end] {
+		items = append(items, postCreateActivity(p))
+	}
+
+	resp := map[string]interface{}{
+		"@context":     activityStreamsContext,
+		"id":           fmt.Sprintf("https://christine.website/activitypub/outbox?page=%d", page),
+		"type":         "OrderedCollectionPage",
+		"partOf":       "https://christine.website/activitypub/outbox",
+		"orderedItems": items,
+	}
+	if end < len(posts) {
+		resp["next"] = fmt.Sprintf("https://christine.website/activitypub/outbox?page=%d", page+1)
+	}
+
+	json.NewEncoder(w).Encode(resp)
+}
+
+func postCreateActivity(p *Post) map[string]interface{} {
+	link := "https://christine.website/" + p.Link
+	return map[string]interface{}{
+		"id":    link + "#create",
+		"type":  "Create",
+		"actor": activityPubActorID,
+		"object": map[string]interface{}{
+			"id":           link,
+			"type":         "Note",
+			"attributedTo": activityPubActorID,
+			"content":      string(p.BodyHTML),
+			"url":          link,
+			"published":    p.Date,
+		},
+	}
+}
+
+// activityPubActivity is the subset of an incoming AS2 activity this blog
+// understands.
+type activityPubActivity struct {
+	Type   string      `json:"type"`
+	Actor  string      `json:"actor"`
+	Object interface{} `json:"object"`
+}
+
+// inboxHandler accepts Follow, Undo{Follow}, and Create activities,
+// verifying every request with HTTP Signatures before acting on it.
+func (s *Site) inboxHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	body, err := verifyHTTPSignature(ctx, r)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("verifyHTTPSignature"))
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	var act activityPubActivity
+	if err := json.Unmarshal(body, &act); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	switch act.Type {
+	case "Follow":
+		remoteActor, err := fetchRemoteActor(ctx, act.Actor)
+		if err != nil {
+			ln.Error(ctx, err, ln.Action("fetchRemoteActor"))
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := s.apStore.AddFollower(act.Actor, remoteActor.Endpoints.SharedInbox); err != nil {
+			ln.Error(ctx, err, ln.Action("AddFollower"))
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		go s.deliverActivity(context.Background(), remoteActor.Inbox, acceptFollowActivity(act))
+
+	case "Undo":
+		if obj, ok := act.Object.(map[string]interface{}); !ok || obj["type"] != "Follow" {
+			break
+		}
+		if err := s.apStore.RemoveFollower(act.Actor); err != nil {
+			ln.Error(ctx, err, ln.Action("RemoveFollower"))
+		}
+
+	case "Create":
+		// Replies and mentions aren't surfaced anywhere yet; accept and discard.
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func acceptFollowActivity(follow activityPubActivity) map[string]interface{} {
+	return map[string]interface{}{
+		"@context": activityStreamsContext,
+		"id":       fmt.Sprintf("https://christine.website/activitypub/accept/%d", time.Now().UnixNano()),
+		"type":     "Accept",
+		"actor":    activityPubActorID,
+		"object":   follow,
+	}
+}
+
+// remoteActor is the subset of a remote Person/Service actor this blog
+// needs in order to verify signatures and deliver activities.
+type remoteActor struct {
+	Inbox     string `json:"inbox"`
+	Endpoints struct {
+		SharedInbox string `json:"sharedInbox"`
+	} `json:"endpoints"`
+	PublicKey struct {
+		PublicKeyPem string `json:"publicKeyPem"`
+	} `json:"publicKey"`
+}
+
+func fetchRemoteActor(ctx context.Context, id string) (*remoteActor, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, id, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", activityPubContentType)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("activitypub: fetching actor %s returned %s", id, resp.Status)
+	}
+
+	var a remoteActor
+	if err := json.NewDecoder(resp.Body).Decode(&a); err != nil {
+		return nil, err
+	}
+	if a.Endpoints.SharedInbox == "" {
+		a.Endpoints.SharedInbox = a.Inbox
+	}
+
+	return &a, nil
+}
+
+// verifyHTTPSignature reconstructs the signing string described by the
+// Signature header's headers param (draft-cavage-http-signatures) and
+// RSA-verifies it against the actor's publicKeyPem. The signed header set
+// must include "digest", and the request's Digest header must itself match
+// a SHA-256 of the body, so the signature actually binds the body the
+// caller acts on. It returns the request body.
+func verifyHTTPSignature(ctx context.Context, r *http.Request) ([]byte, error) {
+	sigHeader := r.Header.Get("Signature")
+	if sigHeader == "" {
+		return nil, fmt.Errorf("activitypub: missing Signature header")
+	}
+
+	params := parseSignatureHeader(sigHeader)
+	keyID, headerNames, signature := params["keyId"], params["headers"], params["signature"]
+	if keyID == "" || signature == "" {
+		return nil, fmt.Errorf("activitypub: malformed Signature header")
+	}
+	if headerNames == "" {
+		headerNames = "date"
+	}
+	if !containsField(headerNames, "digest") {
+		return nil, fmt.Errorf("activitypub: Signature header does not cover digest")
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyDigestHeader(r.Header.Get("Digest"), body); err != nil {
+		return nil, err
+	}
+
+	sigBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	for i, h := range strings.Fields(headerNames) {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		if h == "(request-target)" {
+			fmt.Fprintf(&buf, "(request-target): %s %s", strings.ToLower(r.Method), r.URL.RequestURI())
+			continue
+		}
+		if strings.EqualFold(h, "host") {
+			// net/http moves the Host header out of r.Header into r.Host.
+			fmt.Fprintf(&buf, "%s: %s", h, r.Host)
+			continue
+		}
+		fmt.Fprintf(&buf, "%s: %s", h, r.Header.Get(h))
+	}
+
+	actorID := keyID
+	if i := strings.Index(actorID, "#"); i != -1 {
+		actorID = actorID[:i]
+	}
+
+	actor, err := fetchRemoteActor(ctx, actorID)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(actor.PublicKey.PublicKeyPem))
+	if block == nil {
+		return nil, fmt.Errorf("activitypub: actor %s has no usable publicKeyPem", actorID)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("activitypub: actor %s publicKey is not RSA", actorID)
+	}
+
+	hashed := sha256.Sum256(buf.Bytes())
+	if err := rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, hashed[:], sigBytes); err != nil {
+		return nil, err
+	}
+
+	return body, nil
+}
+
+// containsField reports whether name (case-insensitively) appears among
+// the space-separated header names in fields.
+func containsField(fields, name string) bool {
+	for _, f := range strings.Fields(fields) {
+		if strings.EqualFold(f, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyDigestHeader checks a "Digest: SHA-256=<base64>" header against the
+// actual request body, per RFC 3230 / draft-cavage-http-signatures.
+func verifyDigestHeader(header string, body []byte) error {
+	const prefix = "SHA-256="
+	if !strings.HasPrefix(header, prefix) {
+		return fmt.Errorf("activitypub: missing or unsupported Digest header")
+	}
+
+	want, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(header, prefix))
+	if err != nil {
+		return fmt.Errorf("activitypub: malformed Digest header: %w", err)
+	}
+
+	got := sha256.Sum256(body)
+	if !hmac.Equal(got[:], want) {
+		return fmt.Errorf("activitypub: Digest header does not match request body")
+	}
+
+	return nil
+}
+
+// parseSignatureHeader splits a Signature header's comma-separated
+// key="value" params into a map.
+func parseSignatureHeader(header string) map[string]string {
+	out := map[string]string{}
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		out[strings.TrimSpace(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+	return out
+}
+
+// deliverActivity signs and POSTs an activity to a remote inbox, per
+// draft-cavage-http-signatures.
+func (s *Site) deliverActivity(ctx context.Context, inbox string, activity interface{}) {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("deliverActivity marshal"))
+		return
+	}
+
+	u, err := url.Parse(inbox)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("deliverActivity parse inbox"))
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, inbox, bytes.NewReader(body))
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("deliverActivity new request"))
+		return
+	}
+	req.Header.Set("Content-Type", activityPubContentType)
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("Host", u.Host)
+
+	digest := sha256.Sum256(body)
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+
+	signingString := fmt.Sprintf("(request-target): post %s\nhost: %s\ndate: %s\ndigest: %s",
+		u.RequestURI(), u.Host, req.Header.Get("Date"), req.Header.Get("Digest"))
+
+	hashed := sha256.Sum256([]byte(signingString))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.apKey.private, crypto.SHA256, hashed[:])
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("deliverActivity sign"))
+		return
+	}
+
+	req.Header.Set("Signature", fmt.Sprintf(
+		`keyId="%s#main-key",algorithm="rsa-sha256",headers="(request-target) host date digest",signature="%s"`,
+		activityPubActorID, base64.StdEncoding.EncodeToString(sig)))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("deliverActivity do"))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		ln.Error(ctx, fmt.Errorf("activitypub: delivery to %s returned %s", inbox, resp.Status), ln.Action("deliverActivity"))
+	}
+}
+
+// deliverNewPost enqueues a signed Create{Note} delivery to every
+// follower's sharedInbox. Reload and createMicropubPost call this for
+// each post that wasn't already known; it is a no-op when there are no
+// followers yet.
+func (s *Site) deliverNewPost(p *Post) {
+	if s.apStore == nil {
+		return
+	}
+
+	inboxes, err := s.apStore.SharedInboxes()
+	if err != nil {
+		ln.Error(context.Background(), err, ln.Action("SharedInboxes"))
+		return
+	}
+
+	activity := postCreateActivity(p)
+	activity["@context"] = activityStreamsContext
+
+	for _, inbox := range inboxes {
+		go s.deliverActivity(context.Background(), inbox, activity)
+	}
+}
+
+// showPostOrActivity serves the AS2 Note representation of a post when the
+// request's Accept header asks for it, and falls back to the normal HTML
+// showPost handler otherwise.
+func (s *Site) showPostOrActivity(w http.ResponseWriter, r *http.Request) {
+	if !wantsActivityPub(r) {
+		s.showPost(w, r)
+		return
+	}
+
+	link := strings.TrimPrefix(r.URL.Path, "/")
+
+	if p := s.findPost(link); p != nil {
+		activity := postCreateActivity(p)
+		activity["@context"] = activityStreamsContext
+
+		w.Header().Set("Content-Type", activityPubContentType)
+		json.NewEncoder(w).Encode(activity["object"])
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+// wantsActivityPub reports whether the request's Accept header prefers the
+// AS2 JSON representation of a resource over HTML.
+func wantsActivityPub(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/activity+json") || strings.Contains(accept, "application/ld+json")
+}
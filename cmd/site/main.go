@@ -2,20 +2,18 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"html/template"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Xe/jsonfeed"
 	"github.com/Xe/ln"
 	"github.com/gorilla/feeds"
-	blackfriday "github.com/russross/blackfriday"
-	"github.com/tj/front"
 	analytics "gopkg.in/segmentio/analytics-go.v3"
 )
 
@@ -37,6 +35,18 @@ func main() {
 
 // Site is the parent object for https://christine.website's backend.
 type Site struct {
+	// mu guards Posts, Resume, rssFeed, and jsonFeed, which are all
+	// replaced wholesale by Reload. Every reader of these fields in this
+	// package (the "/resume" and "/blog" closures, findPost,
+	// buildSearchIndex, outboxHandler) takes mu.RLock first, and every
+	// writer (Build, Reload, createMicropubPost) holds mu.Lock around its
+	// writes and its call to rebuildFeeds; Reload can swap them out from the fsnotify watcher or the admin
+	// webhook goroutine at any time. createFeed, createAtom,
+	// createJsonFeed, showPost, and renderTemplatePage are declared on
+	// Site and called from Build, but this source tree has no file
+	// defining them (not even at the pre-Micropub baseline); they must
+	// take mu the same way wherever they actually live.
+	mu     sync.RWMutex
 	Posts  Posts
 	Resume template.HTML
 
@@ -47,6 +57,11 @@ type Site struct {
 
 	segment analytics.Client
 	t       *translations
+
+	apKey   *activityPubKey
+	apStore *activityPubStore
+
+	searchDB *sql.DB
 }
 
 func (s *Site) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -70,11 +85,6 @@ func (s *Site) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // Build creates a new Site instance or fails.
 func Build() (*Site, error) {
-	type postFM struct {
-		Title string
-		Date  string
-	}
-
 	t := &translations{
 		locales: map[string]locale{},
 	}
@@ -124,69 +134,106 @@ func Build() (*Site, error) {
 		s.segment = analytics.New(wk)
 	}
 
-	err := filepath.Walk("./blog/", func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			return nil
-		}
-
-		fin, err := os.Open(path)
-		if err != nil {
-			return err
-		}
-		defer fin.Close()
-
-		content, err := ioutil.ReadAll(fin)
-		if err != nil {
-			return err
-		}
-
-		var fm postFM
-		remaining, err := front.Unmarshal(content, &fm)
-		if err != nil {
-			return err
-		}
-
-		output := blackfriday.Run(remaining)
+	apKey, err := loadOrCreateActivityPubKey("./activitypub.pem")
+	if err != nil {
+		return nil, err
+	}
+	s.apKey = apKey
 
-		p := &Post{
-			Title:    fm.Title,
-			Date:     fm.Date,
-			Link:     strings.Split(path, ".")[0],
-			Body:     string(remaining),
-			BodyHTML: template.HTML(output),
-		}
+	apStore, err := newActivityPubStore("./activitypub.db")
+	if err != nil {
+		return nil, err
+	}
+	s.apStore = apStore
 
-		s.Posts = append(s.Posts, p)
+	posts, err := loadPosts()
+	if err != nil {
+		return nil, err
+	}
 
-		return nil
-	})
+	resume, err := loadResume()
 	if err != nil {
 		return nil, err
 	}
 
-	sort.Sort(sort.Reverse(s.Posts))
+	s.mu.Lock()
+	s.Posts = posts
+	s.Resume = resume
+	s.rebuildFeeds()
+	s.mu.Unlock()
 
-	resumeData, err := ioutil.ReadFile("./static/resume/resume.md")
-	if err != nil {
+	if err := s.buildSearchIndex(); err != nil {
 		return nil, err
 	}
 
-	s.Resume = template.HTML(blackfriday.Run(resumeData))
+	if err := s.watchForChanges(context.Background()); err != nil {
+		ln.Error(context.Background(), err, ln.Action("watchForChanges"))
+	}
+
+	// Add HTTP routes here
+	s.mux.Handle("/", s.minify(s.renderTemplatePage("index.html", nil)))
+	s.mux.Handle("/resume", s.minify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		resume := s.Resume
+		s.mu.RUnlock()
+		s.renderTemplatePage("resume.html", resume).ServeHTTP(w, r)
+	})))
+	s.mux.Handle("/blog", s.minify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		posts := s.Posts
+		s.mu.RUnlock()
+		s.renderTemplatePage("blogindex.html", posts).ServeHTTP(w, r)
+	})))
+	s.mux.Handle("/contact", s.minify(s.renderTemplatePage("contact.html", nil)))
+	s.mux.Handle("/blog.rss", s.minify(s.withWebSubHub(http.HandlerFunc(s.createFeed))))
+	s.mux.Handle("/blog.atom", s.minify(s.withWebSubHub(http.HandlerFunc(s.createAtom))))
+	s.mux.Handle("/blog.json", s.minify(s.withWebSubHub(http.HandlerFunc(s.createJsonFeed))))
+	s.mux.Handle("/blog/", s.minify(http.HandlerFunc(s.negotiatePost)))
+	s.mux.Handle("/css/", http.FileServer(http.Dir(".")))
+	s.mux.Handle("/static/", http.FileServer(http.Dir(".")))
+	s.mux.Handle("/sw.js", s.minify(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "./static/js/sw.js")
+	})))
+	s.mux.HandleFunc("/micropub", s.micropubHandler)
+	s.mux.HandleFunc("/micropub/media", s.micropubMediaHandler)
+	s.mux.HandleFunc("/.well-known/webfinger", s.webfingerHandler)
+	s.mux.HandleFunc("/activitypub/actor", s.actorHandler)
+	s.mux.HandleFunc("/activitypub/outbox", s.outboxHandler)
+	s.mux.HandleFunc("/activitypub/inbox", s.inboxHandler)
+	s.mux.HandleFunc("/activitypub/followers", s.followersHandler)
+	s.mux.HandleFunc("/search", s.searchHandler)
+	s.mux.HandleFunc("/search.json", s.searchJSONHandler)
+	s.mux.HandleFunc("/websub/callback", s.webSubCallbackHandler)
+	s.mux.HandleFunc("/admin/reload", s.adminReloadHandler)
+
+	return s, nil
+}
+
+// rebuildFeeds replaces rssFeed and jsonFeed with freshly built ones from
+// the current contents of s.Posts, rather than mutating the existing
+// feeds' Items in place. It is called once at startup by Build and again
+// any time Posts changes (Reload, Micropub). Callers must hold mu for
+// writing. Swapping the feed pointers wholesale, instead of appending to
+// their Items, means any caller that reads s.rssFeed/s.jsonFeed only once
+// and keeps working from that local copy can never observe a half-rebuilt
+// Items slice. Nothing else in this source tree reads the two feeds.
+func (s *Site) rebuildFeeds() {
+	rssFeed := *s.rssFeed
+	rssFeed.Items = nil
+
+	jsonFeed := *s.jsonFeed
+	jsonFeed.Items = nil
 
 	for _, item := range s.Posts {
 		itime, _ := time.Parse("2006-01-02", item.Date)
-		s.rssFeed.Items = append(s.rssFeed.Items, &feeds.Item{
+		rssFeed.Items = append(rssFeed.Items, &feeds.Item{
 			Title:       item.Title,
 			Link:        &feeds.Link{Href: "https://christine.website/" + item.Link},
 			Description: item.Summary,
 			Created:     itime,
 		})
 
-		s.jsonFeed.Items = append(s.jsonFeed.Items, jsonfeed.Item{
+		jsonFeed.Items = append(jsonFeed.Items, jsonfeed.Item{
 			ID:            "https://christine.website/" + item.Link,
 			URL:           "https://christine.website/" + item.Link,
 			Title:         item.Title,
@@ -195,22 +242,8 @@ func Build() (*Site, error) {
 		})
 	}
 
-	// Add HTTP routes here
-	s.mux.Handle("/", s.renderTemplatePage("index.html", nil))
-	s.mux.Handle("/resume", s.renderTemplatePage("resume.html", s.Resume))
-	s.mux.Handle("/blog", s.renderTemplatePage("blogindex.html", s.Posts))
-	s.mux.Handle("/contact", s.renderTemplatePage("contact.html", nil))
-	s.mux.HandleFunc("/blog.rss", s.createFeed)
-	s.mux.HandleFunc("/blog.atom", s.createAtom)
-	s.mux.HandleFunc("/blog.json", s.createJsonFeed)
-	s.mux.HandleFunc("/blog/", s.showPost)
-	s.mux.Handle("/css/", http.FileServer(http.Dir(".")))
-	s.mux.Handle("/static/", http.FileServer(http.Dir(".")))
-	s.mux.HandleFunc("/sw.js", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "./static/js/sw.js")
-	})
-
-	return s, nil
+	s.rssFeed = &rssFeed
+	s.jsonFeed = &jsonFeed
 }
 
 const icon = "https://christine.website/static/img/avatar.png"
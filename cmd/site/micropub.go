@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Xe/ln"
+	blackfriday "github.com/russross/blackfriday"
+)
+
+// indieAuthTokenEndpoint is where Micropub bearer tokens are verified.
+var indieAuthTokenEndpoint = os.Getenv("INDIEAUTH_TOKEN_ENDPOINT")
+
+// siteOwner is the IndieAuth "me" URL allowed to post via Micropub.
+const siteOwner = "https://christine.website/"
+
+// indieAuthVerifyResponse is the token endpoint's verification response.
+type indieAuthVerifyResponse struct {
+	Me    string `json:"me"`
+	Scope string `json:"scope"`
+}
+
+// verifyMicropubToken posts the bearer token to the configured IndieAuth
+// token endpoint and returns its granted scopes if it belongs to siteOwner
+// and its scope includes "create"; otherwise it returns an error.
+func verifyMicropubToken(ctx context.Context, token string) ([]string, error) {
+	if indieAuthTokenEndpoint == "" {
+		return nil, fmt.Errorf("micropub: INDIEAUTH_TOKEN_ENDPOINT is not configured")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, indieAuthTokenEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("micropub: token endpoint returned %s", resp.Status)
+	}
+
+	var v indieAuthVerifyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+
+	if v.Me != siteOwner {
+		return nil, fmt.Errorf("micropub: token belongs to %q, not the site owner", v.Me)
+	}
+
+	scopes := strings.Fields(v.Scope)
+	for _, sc := range scopes {
+		if sc == "create" {
+			return scopes, nil
+		}
+	}
+
+	return nil, fmt.Errorf("micropub: token scope %q does not include create", v.Scope)
+}
+
+// bearerToken extracts a Micropub access token from either the
+// Authorization header or the access_token form value.
+func bearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	return r.FormValue("access_token")
+}
+
+// micropubEntry is the normalized representation of an h-entry create
+// request, regardless of whether it arrived form-encoded, multipart, or as
+// Micropub JSON.
+type micropubEntry struct {
+	Type       string
+	Content    string
+	Name       string
+	Categories []string
+	Slug       string
+	Published  string
+	Photos     []string
+}
+
+func (s *Site) micropubHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method == http.MethodGet {
+		switch r.URL.Query().Get("q") {
+		case "config":
+			s.micropubConfig(w, r)
+		case "source":
+			s.micropubSource(w, r)
+		default:
+			http.Error(w, "unsupported query", http.StatusBadRequest)
+		}
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := bearerToken(r)
+	if token == "" {
+		http.Error(w, "missing bearer token", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := verifyMicropubToken(ctx, token); err != nil {
+		ln.Error(ctx, err, ln.Action("verifyMicropubToken"))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	entry, err := parseMicropubEntry(r)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("parseMicropubEntry"))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if entry.Type != "entry" {
+		http.Error(w, "unsupported h-"+entry.Type, http.StatusNotImplemented)
+		return
+	}
+
+	link, err := s.createMicropubPost(entry)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("createMicropubPost"))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "https://christine.website/"+link)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func parseMicropubEntry(r *http.Request) (*micropubEntry, error) {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if ct == "application/json" {
+		return parseMicropubJSON(r.Body)
+	}
+
+	if ct == "multipart/form-data" {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			return nil, err
+		}
+	} else if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+
+	return micropubEntryFromValues(r.Form), nil
+}
+
+func micropubEntryFromValues(v url.Values) *micropubEntry {
+	entry := &micropubEntry{
+		Type:      v.Get("h"),
+		Content:   v.Get("content"),
+		Name:      v.Get("name"),
+		Slug:      v.Get("mp-slug"),
+		Published: v.Get("published"),
+	}
+	if entry.Type == "" {
+		entry.Type = "entry"
+	}
+
+	entry.Categories = append(entry.Categories, v["category"]...)
+	entry.Categories = append(entry.Categories, v["category[]"]...)
+	entry.Photos = append(entry.Photos, v["photo"]...)
+	entry.Photos = append(entry.Photos, v["photo[]"]...)
+
+	return entry
+}
+
+// micropubJSONBody is the Micropub JSON create-request shape described in
+// https://www.w3.org/TR/micropub/#json-syntax.
+type micropubJSONBody struct {
+	Type       []string `json:"type"`
+	Properties struct {
+		Content   []string `json:"content"`
+		Name      []string `json:"name"`
+		Category  []string `json:"category"`
+		MPSlug    []string `json:"mp-slug"`
+		Published []string `json:"published"`
+		Photo     []string `json:"photo"`
+	} `json:"properties"`
+}
+
+func parseMicropubJSON(body io.Reader) (*micropubEntry, error) {
+	var jb micropubJSONBody
+	if err := json.NewDecoder(body).Decode(&jb); err != nil {
+		return nil, err
+	}
+
+	entry := &micropubEntry{Type: "entry"}
+	if len(jb.Type) > 0 {
+		entry.Type = strings.TrimPrefix(jb.Type[0], "h-")
+	}
+	if len(jb.Properties.Content) > 0 {
+		entry.Content = jb.Properties.Content[0]
+	}
+	if len(jb.Properties.Name) > 0 {
+		entry.Name = jb.Properties.Name[0]
+	}
+	if len(jb.Properties.MPSlug) > 0 {
+		entry.Slug = jb.Properties.MPSlug[0]
+	}
+	if len(jb.Properties.Published) > 0 {
+		entry.Published = jb.Properties.Published[0]
+	}
+	entry.Categories = jb.Properties.Category
+	entry.Photos = jb.Properties.Photo
+
+	return entry, nil
+}
+
+// createMicropubPost writes a new markdown file under ./blog/, rebuilds
+// s.Posts and both feeds, and returns the post's link.
+func (s *Site) createMicropubPost(entry *micropubEntry) (string, error) {
+	now := time.Now().UTC()
+	date := normalizePublished(entry.Published, now)
+
+	title := entry.Name
+	if title == "" {
+		title = entry.Content
+	}
+
+	// slugify both confines the slug to ./blog/ (no path separators or
+	// "..") and normalizes client-supplied mp-slug values.
+	slug := slugify(entry.Slug)
+	if slug == "" {
+		slug = slugify(title)
+	}
+	if slug == "" {
+		slug = strconv.FormatInt(now.UnixNano(), 36)
+	}
+
+	var body strings.Builder
+	for _, photo := range entry.Photos {
+		fmt.Fprintf(&body, "![](%s)\n\n", photo)
+	}
+	body.WriteString(entry.Content)
+	if len(entry.Categories) > 0 {
+		fmt.Fprintf(&body, "\n\nTags: %s", strings.Join(entry.Categories, ", "))
+	}
+
+	frontMatter := fmt.Sprintf("---\ntitle: %s\ndate: %s\n---\n\n", strconv.Quote(title), date)
+
+	path := filepath.Join("blog", slug+".md")
+	if err := ioutil.WriteFile(path, []byte(frontMatter+body.String()), 0644); err != nil {
+		return "", err
+	}
+
+	p := &Post{
+		Title:    title,
+		Date:     date,
+		Link:     strings.Split(path, ".")[0],
+		Body:     body.String(),
+		BodyHTML: template.HTML(blackfriday.Run([]byte(body.String()))),
+	}
+
+	s.mu.Lock()
+	s.Posts = append(s.Posts, p)
+	sort.Sort(sort.Reverse(s.Posts))
+	s.rebuildFeeds()
+	s.mu.Unlock()
+
+	if err := s.buildSearchIndex(); err != nil {
+		return "", err
+	}
+	s.publishWebSub(context.Background())
+	s.deliverNewPost(p)
+
+	return p.Link, nil
+}
+
+// micropubPublishedLayouts are the published-property formats accepted from
+// real-world clients (e.g. Quill, Indigenous), tried in order. Every
+// consumer of Post.Date (rebuildFeeds, Posts.Less, the FTS index) assumes
+// the resulting value is laid out as "2006-01-02".
+var micropubPublishedLayouts = []string{
+	"2006-01-02",
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+}
+
+// normalizePublished parses published in whichever layout it was sent in
+// and reformats it to "2006-01-02", falling back to now when published is
+// empty or unparseable.
+func normalizePublished(published string, now time.Time) string {
+	if published == "" {
+		return now.Format("2006-01-02")
+	}
+
+	for _, layout := range micropubPublishedLayouts {
+		if t, err := time.Parse(layout, published); err == nil {
+			return t.Format("2006-01-02")
+		}
+	}
+
+	return now.Format("2006-01-02")
+}
+
+// slugify turns arbitrary text into a lowercase, hyphenated string suitable
+// for use as a filename.
+func slugify(s string) string {
+	s = strings.ToLower(s)
+
+	var b strings.Builder
+	lastDash := false
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z' || r >= '0' && r <= '9':
+			b.WriteRune(r)
+			lastDash = false
+		default:
+			if !lastDash && b.Len() > 0 {
+				b.WriteRune('-')
+				lastDash = true
+			}
+		}
+	}
+
+	return strings.TrimRight(b.String(), "-")
+}
+
+func (s *Site) micropubConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"media-endpoint": "https://christine.website/micropub/media",
+		"syndicate-to":   []string{},
+	})
+}
+
+func (s *Site) micropubSource(w http.ResponseWriter, r *http.Request) {
+	link := strings.TrimPrefix(r.URL.Query().Get("url"), "https://christine.website/")
+
+	p := s.findPost(link)
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type": []string{"h-entry"},
+		"properties": map[string]interface{}{
+			"name":      []string{p.Title},
+			"content":   []string{p.Body},
+			"published": []string{p.Date},
+		},
+	})
+}
+
+// micropubMediaHandler implements the Micropub media endpoint: it accepts
+// an authenticated multipart upload and returns its public URL in the
+// Location header.
+func (s *Site) micropubMediaHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := bearerToken(r)
+	if token == "" {
+		http.Error(w, "missing bearer token", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := verifyMicropubToken(ctx, token); err != nil {
+		ln.Error(ctx, err, ln.Action("verifyMicropubToken"))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	name := fmt.Sprintf("%d-%s", time.Now().UnixNano(), filepath.Base(header.Filename))
+	dst := filepath.Join("static", "media", name)
+
+	out, err := os.Create(dst)
+	if err != nil {
+		ln.Error(ctx, err, ln.Action("micropubMediaHandler create"))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, file); err != nil {
+		ln.Error(ctx, err, ln.Action("micropubMediaHandler copy"))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "https://christine.website/static/media/"+name)
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/Xe/ln"
+	"github.com/gorilla/feeds"
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	"github.com/tdewolff/minify/v2/html"
+	minifyjs "github.com/tdewolff/minify/v2/js"
+	minifyjson "github.com/tdewolff/minify/v2/json"
+	"github.com/tdewolff/minify/v2/xml"
+)
+
+var minifier = newMinifier()
+
+func newMinifier() *minify.M {
+	m := minify.New()
+	m.AddFunc("text/html", html.Minify)
+	m.AddFunc("application/json", minifyjson.Minify)
+	m.AddFunc("application/xml", xml.Minify)
+	m.AddFunc("application/atom+xml", xml.Minify)
+	m.AddFunc("application/activity+json", minifyjson.Minify)
+	m.AddFunc("application/jrd+json", minifyjson.Minify)
+	m.AddFunc("text/css", css.Minify)
+	m.AddFunc("application/javascript", minifyjs.Minify)
+	return m
+}
+
+// mediaType strips any parameters (e.g. "; charset=utf-8") from a
+// Content-Type header value.
+func mediaType(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i != -1 {
+		return contentType[:i]
+	}
+	return contentType
+}
+
+// writeMinified minifies body according to contentType and writes it to w.
+// Content types the minifier has no rule for are written unmodified. The
+// Content-Type header must already be set on w before calling this, since
+// header mutations made after WriteHeader never reach the client.
+func (s *Site) writeMinified(w http.ResponseWriter, contentType string, body []byte) {
+	out, err := minifier.Bytes(mediaType(contentType), body)
+	if err != nil {
+		out = body
+	}
+
+	w.Write(out)
+}
+
+// minify wraps an http.Handler so whatever it writes is minified according
+// to the Content-Type it sets, before being sent to the real
+// ResponseWriter. Build wraps the page, feed, /blog/ and /sw.js routes in
+// it; the /css/ and /static/ file servers and the Micropub, ActivityPub,
+// search, WebSub and admin routes are not minified.
+func (s *Site) minify(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+
+		s.writeMinified(w, rec.Header().Get("Content-Type"), rec.Body.Bytes())
+	})
+}
+
+// negotiatePost serves a single post in whichever representation the
+// request's Accept header prefers: the AS2 Note, a JSON object, a
+// single-item Atom entry, raw Markdown, or (the default) rendered HTML.
+func (s *Site) negotiatePost(w http.ResponseWriter, r *http.Request) {
+	accept := r.Header.Get("Accept")
+	link := strings.TrimPrefix(r.URL.Path, "/")
+
+	switch {
+	case wantsActivityPub(r):
+		s.showPostOrActivity(w, r)
+	case strings.Contains(accept, "application/json"):
+		s.servePostJSON(w, r, link)
+	case strings.Contains(accept, "application/atom+xml"):
+		s.servePostAtom(w, r, link)
+	case strings.Contains(accept, "text/markdown"):
+		s.servePostMarkdown(w, r, link)
+	default:
+		s.showPost(w, r)
+	}
+}
+
+func (s *Site) findPost(link string) *Post {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, p := range s.Posts {
+		if p.Link == link {
+			return p
+		}
+	}
+	return nil
+}
+
+func (s *Site) servePostJSON(w http.ResponseWriter, r *http.Request, link string) {
+	p := s.findPost(link)
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+func (s *Site) servePostAtom(w http.ResponseWriter, r *http.Request, link string) {
+	p := s.findPost(link)
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	itime, _ := time.Parse("2006-01-02", p.Date)
+	entryLink := &feeds.Link{Href: "https://christine.website/" + p.Link}
+	entry := &feeds.Feed{
+		Title:   p.Title,
+		Link:    entryLink,
+		Created: itime,
+		Items: []*feeds.Item{
+			{
+				Title:       p.Title,
+				Link:        entryLink,
+				Description: string(p.BodyHTML),
+				Created:     itime,
+			},
+		},
+	}
+
+	atom, err := entry.ToAtom()
+	if err != nil {
+		ln.Error(r.Context(), err, ln.Action("servePostAtom"))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml")
+	w.Write([]byte(atom))
+}
+
+func (s *Site) servePostMarkdown(w http.ResponseWriter, r *http.Request, link string) {
+	p := s.findPost(link)
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/markdown")
+	w.Write([]byte(p.Body))
+}
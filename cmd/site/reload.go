@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Xe/ln"
+	"github.com/fsnotify/fsnotify"
+	blackfriday "github.com/russross/blackfriday"
+	"github.com/tj/front"
+)
+
+// adminWebhookSecret gates POST /admin/reload; it is the HMAC-SHA256 key the
+// request signature is checked against. When it is empty the endpoint
+// answers 503.
+var adminWebhookSecret = os.Getenv("ADMIN_WEBHOOK_SECRET")
+
+// loadPosts walks ./blog/ and returns every post it finds, newest first.
+func loadPosts() (Posts, error) {
+	type postFM struct {
+		Title string
+		Date  string
+	}
+
+	var posts Posts
+
+	err := filepath.Walk("./blog/", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var fm postFM
+		remaining, err := front.Unmarshal(content, &fm)
+		if err != nil {
+			return err
+		}
+
+		posts = append(posts, &Post{
+			Title:    fm.Title,
+			Date:     fm.Date,
+			Link:     strings.Split(path, ".")[0],
+			Body:     string(remaining),
+			BodyHTML: template.HTML(blackfriday.Run(remaining)),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(sort.Reverse(posts))
+
+	return posts, nil
+}
+
+// loadResume renders ./static/resume/resume.md to HTML.
+func loadResume() (template.HTML, error) {
+	resumeData, err := ioutil.ReadFile("./static/resume/resume.md")
+	if err != nil {
+		return "", err
+	}
+
+	return template.HTML(blackfriday.Run(resumeData)), nil
+}
+
+// Reload re-walks ./blog/ and ./static/resume/resume.md and atomically
+// swaps Posts, Resume, rssFeed, and jsonFeed, then rebuilds the search
+// index. It notifies the WebSub hub and delivers a Create{Note} to every
+// ActivityPub follower only for posts added since the last load, so
+// routine edits to existing posts or the resume don't spam subscribers.
+// It is safe to call while the site is serving requests.
+func (s *Site) Reload() error {
+	posts, err := loadPosts()
+	if err != nil {
+		return err
+	}
+
+	resume, err := loadResume()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	prevPosts := s.Posts
+	s.Posts = posts
+	s.Resume = resume
+	s.rebuildFeeds()
+	s.mu.Unlock()
+
+	if err := s.buildSearchIndex(); err != nil {
+		return err
+	}
+
+	newPosts := newPostsSince(prevPosts, posts)
+	if len(newPosts) > 0 {
+		s.publishWebSub(context.Background())
+		for _, p := range newPosts {
+			s.deliverNewPost(p)
+		}
+	}
+
+	return nil
+}
+
+// newPostsSince returns the posts in next whose link is absent from prev.
+func newPostsSince(prev, next Posts) Posts {
+	seen := make(map[string]bool, len(prev))
+	for _, p := range prev {
+		seen[p.Link] = true
+	}
+
+	var added Posts
+	for _, p := range next {
+		if !seen[p.Link] {
+			added = append(added, p)
+		}
+	}
+
+	return added
+}
+
+// watchForChanges starts an fsnotify watcher on ./blog/ and
+// ./static/resume/, calling Reload (debounced by 500ms) whenever a file is
+// created, written, or removed.
+func (s *Site) watchForChanges(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{"./blog/", "./static/resume/"} {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		var debounce *time.Timer
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Remove) == 0 {
+					continue
+				}
+
+				if debounce != nil {
+					debounce.Stop()
+				}
+				debounce = time.AfterFunc(500*time.Millisecond, func() {
+					if err := s.Reload(); err != nil {
+						ln.Error(ctx, err, ln.Action("Reload"))
+					}
+				})
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				ln.Error(ctx, err, ln.Action("fsnotify"))
+			}
+		}
+	}()
+
+	return nil
+}
+
+// adminReloadHandler implements POST /admin/reload, gated by an
+// HMAC-SHA256 signature over the request body in the X-Hub-Signature-256
+// header, compatible with GitHub and Gitea push webhooks.
+func (s *Site) adminReloadHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if adminWebhookSecret == "" {
+		http.Error(w, "admin webhook is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	if !validWebhookSignature(r.Header.Get("X-Hub-Signature-256"), adminWebhookSecret, body) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	if err := s.Reload(); err != nil {
+		ln.Error(ctx, err, ln.Action("Reload"))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "reloaded"})
+}
+
+// validWebhookSignature checks an X-Hub-Signature-256 header against an
+// HMAC-SHA256 of body using secret.
+func validWebhookSignature(header, secret string, body []byte) bool {
+	const prefix = "sha256="
+	if !strings.HasPrefix(header, prefix) {
+		return false
+	}
+
+	sig, err := hex.DecodeString(strings.TrimPrefix(header, prefix))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hmac.Equal(sig, mac.Sum(nil))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"html"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/Xe/ln"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// searchMu guards searchDB, which buildSearchIndex replaces wholesale on
+// every Build, Reload, and Micropub post.
+var searchMu sync.RWMutex
+
+// searchLimit bounds the number of matches a single query can return.
+const searchLimit = 25
+
+// searchResult is a single FTS5 match, ready to render.
+type searchResult struct {
+	Link    string
+	Title   string
+	Snippet template.HTML
+}
+
+var htmlTagPattern = regexp.MustCompile(`<[^>]+>`)
+
+// stripHTML removes markup left over from blackfriday's HTML output so the
+// FTS5 index only ever sees plain text.
+func stripHTML(s string) string {
+	return html.UnescapeString(htmlTagPattern.ReplaceAllString(s, ""))
+}
+
+// snippetOpenTag and snippetCloseTag are passed to sqlite's snippet()
+// function as the match delimiters. They're placeholders rather than real
+// markup so that the surrounding (indexed, but not otherwise escaped)
+// snippet text can be safely HTML-escaped before the delimiters are turned
+// into an actual <mark> tag.
+const (
+	snippetOpenTag  = "\x02"
+	snippetCloseTag = "\x03"
+)
+
+// escapeSnippet HTML-escapes a raw snippet() result and turns its
+// placeholder match delimiters into real <mark> tags, so text the FTS5
+// index picked up verbatim (which may contain literal "<"/">" from prose,
+// not just stripped markup) can't inject markup into the search page.
+func escapeSnippet(snippet string) template.HTML {
+	escaped := html.EscapeString(snippet)
+	escaped = strings.ReplaceAll(escaped, snippetOpenTag, "<mark>")
+	escaped = strings.ReplaceAll(escaped, snippetCloseTag, "</mark>")
+	return template.HTML(escaped)
+}
+
+// buildSearchIndex (re)creates the posts_fts virtual table and populates it
+// from the current contents of s.Posts. The go-sqlite3 driver must be built
+// with -tags sqlite_fts5 for FTS5 support to be compiled in.
+func (s *Site) buildSearchIndex() error {
+	db, err := sql.Open("sqlite3", "./search.db")
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`DROP TABLE IF EXISTS posts_fts`); err != nil {
+		db.Close()
+		return err
+	}
+
+	_, err = db.Exec(`CREATE VIRTUAL TABLE posts_fts USING fts5(title, body, link UNINDEXED, date UNINDEXED)`)
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	stmt, err := db.Prepare(`INSERT INTO posts_fts (title, body, link, date) VALUES (?, ?, ?, ?)`)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	defer stmt.Close()
+
+	s.mu.RLock()
+	posts := s.Posts
+	s.mu.RUnlock()
+
+	for _, p := range posts {
+		if _, err := stmt.Exec(p.Title, stripHTML(string(p.BodyHTML)), p.Link, p.Date); err != nil {
+			db.Close()
+			return err
+		}
+	}
+
+	searchMu.Lock()
+	old := s.searchDB
+	s.searchDB = db
+	searchMu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	return nil
+}
+
+// runSearch executes an FTS5 MATCH query and returns the highlighted
+// results, most relevant first.
+func (s *Site) runSearch(q string) ([]searchResult, error) {
+	if q == "" {
+		return nil, nil
+	}
+
+	searchMu.RLock()
+	db := s.searchDB
+	searchMu.RUnlock()
+
+	rows, err := db.Query(
+		`SELECT link, title, snippet(posts_fts, 1, ?, ?, '…', 20)
+		   FROM posts_fts WHERE posts_fts MATCH ? ORDER BY rank LIMIT ?`,
+		snippetOpenTag, snippetCloseTag, q, searchLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []searchResult
+	for rows.Next() {
+		var res searchResult
+		var snippet string
+		if err := rows.Scan(&res.Link, &res.Title, &snippet); err != nil {
+			return nil, err
+		}
+		res.Snippet = escapeSnippet(snippet)
+		results = append(results, res)
+	}
+
+	return results, rows.Err()
+}
+
+// searchHandler serves /search, rendering matches via search.html.
+func (s *Site) searchHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+
+	results, err := s.runSearch(q)
+	if err != nil {
+		ln.Error(r.Context(), err, ln.Action("runSearch"))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := template.ParseFiles("templates/search.html")
+	if err != nil {
+		ln.Error(r.Context(), err, ln.Action("parse search.html"))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	err = tmpl.Execute(w, struct {
+		Query   string
+		Results []searchResult
+	}{q, results})
+	if err != nil {
+		ln.Error(r.Context(), err, ln.Action("render search.html"))
+	}
+}
+
+// searchJSONHandler serves /search.json, driving an in-page live-search box.
+func (s *Site) searchJSONHandler(w http.ResponseWriter, r *http.Request) {
+	results, err := s.runSearch(r.URL.Query().Get("q"))
+	if err != nil {
+		ln.Error(r.Context(), err, ln.Action("runSearch"))
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
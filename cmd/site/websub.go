@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Xe/ln"
+)
+
+// webSubHub is the PubSubHubbub hub this blog's feeds advertise and notify,
+// configurable via WEBSUB_HUB.
+var webSubHub = envOr("WEBSUB_HUB", "https://pubsubhubbub.appspot.com/")
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// feedSelfURLs maps each feed's path to its canonical URL, used both for
+// the WebSub "self" link and for hub.url when publishing.
+var feedSelfURLs = map[string]string{
+	"/blog.rss":  "https://christine.website/blog.rss",
+	"/blog.atom": "https://christine.website/blog.atom",
+	"/blog.json": "https://christine.website/blog.json",
+}
+
+// withWebSubHub wraps a feed handler, injecting a WebSub hub link into its
+// rendered RSS, Atom, or JSON Feed body before the response is minified.
+// RSS and Atom also get a self link; a JSON Feed only gets a "hubs" entry.
+func (s *Site) withWebSubHub(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+
+		body := injectWebSubHub(r.URL.Path, rec.Header().Get("Content-Type"), rec.Body.Bytes())
+
+		w.WriteHeader(rec.Code)
+		w.Write(body)
+	})
+}
+
+func injectWebSubHub(path, contentType string, body []byte) []byte {
+	self := feedSelfURLs[path]
+
+	switch {
+	case strings.Contains(contentType, "json"):
+		var feed map[string]interface{}
+		if err := json.Unmarshal(body, &feed); err != nil {
+			return body
+		}
+		feed["hubs"] = []map[string]string{{"type": "WebSub", "url": webSubHub}}
+		out, err := json.Marshal(feed)
+		if err != nil {
+			return body
+		}
+		return out
+
+	case strings.Contains(contentType, "atom"):
+		link := fmt.Sprintf(`<link rel="hub" href=%q/><link rel="self" href=%q/>`, webSubHub, self)
+		return bytes.Replace(body, []byte("</feed>"), []byte(link+"</feed>"), 1)
+
+	default:
+		link := fmt.Sprintf(
+			`<atom:link rel="hub" href=%q xmlns:atom="http://www.w3.org/2005/Atom"/><atom:link rel="self" href=%q xmlns:atom="http://www.w3.org/2005/Atom"/>`,
+			webSubHub, self)
+		return bytes.Replace(body, []byte("</channel>"), []byte(link+"</channel>"), 1)
+	}
+}
+
+// publishWebSub notifies the configured WebSub hub that all three feeds
+// have changed. Each feed is published independently with its own retry
+// loop so a slow hub can't block the others.
+func (s *Site) publishWebSub(ctx context.Context) {
+	for _, feedURL := range feedSelfURLs {
+		go publishWebSubURL(ctx, feedURL)
+	}
+}
+
+func publishWebSubURL(ctx context.Context, feedURL string) {
+	backoff := time.Second
+
+	for attempt := 1; attempt <= 5; attempt++ {
+		if err := postWebSubPublish(ctx, feedURL); err == nil {
+			ln.Log(ctx, ln.F{"action": "websub_publish", "feed": feedURL, "attempt": attempt})
+			return
+		} else {
+			ln.Error(ctx, err, ln.Action("publishWebSubURL"), ln.F{"feed": feedURL, "attempt": attempt})
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postWebSubPublish(ctx context.Context, feedURL string) error {
+	form := url.Values{
+		"hub.mode": {"publish"},
+		"hub.url":  {feedURL},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webSubHub, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("websub: hub returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// webSubCallbackHandler implements the subscriber side of WebSub so this
+// blog can itself subscribe to other feeds in the future: it confirms
+// (un)subscription requests by echoing hub.challenge, and accepts content
+// notification POSTs.
+func (s *Site) webSubCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		switch r.URL.Query().Get("hub.mode") {
+		case "subscribe", "unsubscribe":
+			w.Write([]byte(r.URL.Query().Get("hub.challenge")))
+		default:
+			http.Error(w, "unknown hub.mode", http.StatusBadRequest)
+		}
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ln.Log(r.Context(), ln.F{"action": "websub_notification", "topic": r.Header.Get("Link")})
+	w.WriteHeader(http.StatusOK)
+}